@@ -3,62 +3,281 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"strings"
 	"time"
 
-	"github.com/kylelemons/go-gypsy/yaml"
 	etcd "go.etcd.io/etcd/clientv3"
 	"gopkg.in/urfave/cli.v1"
 )
 
+// buildTLSConfig assembles a *tls.Config for the etcd client from the
+// --cert/--key/--cacert/--insecure-skip-verify flags. It returns a nil
+// config when none of the TLS flags are set, so plaintext connections are
+// unaffected. These flags live on the root app so buildTLSConfig reads them
+// with Global* accessors, which resolve correctly whether c is the root
+// context or a subcommand's.
+func buildTLSConfig(c *cli.Context) (*tls.Config, error) {
+	certFile := c.GlobalString("cert")
+	keyFile := c.GlobalString("key")
+	caFile := c.GlobalString("cacert")
+	insecureSkipVerify := c.GlobalBool("insecure-skip-verify")
+
+	if certFile == "" && keyFile == "" && caFile == "" && !insecureSkipVerify {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecureSkipVerify}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client cert/key: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if caFile != "" {
+		caCert, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA cert %s: %v", caFile, err)
+		}
+		caPool := x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		tlsConfig.RootCAs = caPool
+	}
+
+	return tlsConfig, nil
+}
+
 var client *etcd.Client
 
-func writeEtcdKV(key string, value []byte) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	_, err := client.Put(ctx, key, string(value))
-	cancel()
+// lastAppliedRevision is the highest etcd revision this process has itself
+// committed. The watch subcommand uses it to tell its own writes apart from
+// externally caused drift.
+var lastAppliedRevision int64
+
+// connectClient builds the shared etcd client from the root app's
+// connection, TLS, and auth flags. It is called once before dispatching to
+// the default import action or to the watch or export subcommand.
+func connectClient(c *cli.Context) error {
+	tlsConfig, err := buildTLSConfig(c)
+	if err != nil {
+		return err
+	}
+
+	username, password := c.GlobalString("user"), c.GlobalString("password")
+	if idx := strings.IndexByte(username, ':'); password == "" && idx >= 0 {
+		username, password = username[:idx], username[idx+1:]
+	}
+
+	client, err = etcd.New(etcd.Config{
+		Endpoints:   strings.Split(c.GlobalString("connect"), ","),
+		DialTimeout: 5 * time.Second,
+		TLS:         tlsConfig,
+		Username:    username,
+		Password:    password,
+	})
+	return err
+}
+
+// defaultMaxTxnOps mirrors etcd's own --max-txn-ops default; a single Txn
+// cannot carry more operations than the server is configured to accept.
+const defaultMaxTxnOps = 128
+
+// changeKind describes what a planned key/value change will do to etcd.
+type changeKind int
+
+const (
+	changeAdd changeKind = iota
+	changeUpdate
+	changeNoop
+	changeDelete
+)
+
+// kvChange is one planned mutation, produced by planChanges and consumed by
+// either logPlan (dry-run preview) or applyPlan (the real Txn commit).
+type kvChange struct {
+	Key   string
+	Value []byte
+	Kind  changeKind
+}
+
+// childPrefix turns a trimmed etcd prefix into the string to match with
+// etcd.WithPrefix(). WithPrefix() does a raw byte-string prefix match, not a
+// path-segment match, so matching on prefix alone would also pull in
+// sibling keys like "/service/demo-staging/x" or "/service/demo2" for a
+// prefix of "/service/demo". Appending the path separator restricts the
+// match to actual children of prefix.
+func childPrefix(prefix string) string {
+	return prefix + "/"
+}
+
+// fetchExisting reads every key currently stored under prefix so it can be
+// diffed against the desired state from the YAML file.
+func fetchExisting(ctx context.Context, prefix string) (map[string][]byte, error) {
+	resp, err := client.Get(ctx, childPrefix(prefix), etcd.WithPrefix())
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+
+	existing := make(map[string][]byte, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		existing[string(kv.Key)] = kv.Value
+	}
+	return existing, nil
 }
 
-func nodeIterator(path string, node yaml.Node) {
+// planChanges diffs the desired key/value set parsed from the YAML file
+// against what is currently in etcd. When prune is set, keys that exist
+// under the prefix but are absent from the YAML are scheduled for deletion.
+func planChanges(desired, existing map[string][]byte, prune bool) []kvChange {
+	changes := make([]kvChange, 0, len(desired))
 
-	yamlMap, isYamlMap := node.(yaml.Map)
-	if isYamlMap {
-		for key, node := range yamlMap {
-			nodeIterator(fmt.Sprint(path, "/", key), node)
+	for key, value := range desired {
+		old, ok := existing[key]
+		switch {
+		case !ok:
+			changes = append(changes, kvChange{key, value, changeAdd})
+		case !bytes.Equal(old, value):
+			changes = append(changes, kvChange{key, value, changeUpdate})
+		default:
+			changes = append(changes, kvChange{key, value, changeNoop})
 		}
-		return
 	}
 
-	yamlScalar, isYamlScalar := node.(yaml.Scalar)
-	if isYamlScalar {
-		writeEtcdKV(path, []byte(yamlScalar))
-		log.Printf("Key: \"%s\" Data: \"%s\"\n", strings.TrimLeft(path, "/"), yamlScalar)
-		return
+	if prune {
+		for key := range existing {
+			if _, ok := desired[key]; !ok {
+				changes = append(changes, kvChange{key, nil, changeDelete})
+			}
+		}
 	}
 
-	yamlList, isYamlList := node.(yaml.List)
-	if isYamlList {
-		buf := bytes.NewBuffer(nil)
-		for _, fileNameNode := range yamlList {
-			fileName, _ := fileNameNode.(yaml.Scalar)
-			file, err := os.Open(string(fileName))
-			if err != nil {
-				log.Fatal(err)
+	return changes
+}
+
+// logPlan prints the planned diff in the same "Key: ... Data: ..." style
+// the tool has always logged in. Unchanged keys are only printed when
+// dryRun is set, so a real run logs only the keys it adds, updates or prunes.
+func logPlan(changes []kvChange, dryRun bool) {
+	for _, change := range changes {
+		key := strings.TrimLeft(change.Key, "/")
+		switch change.Kind {
+		case changeAdd:
+			log.Printf("Key: \"%s\" Data: \"%s\" (add)\n", key, change.Value)
+		case changeUpdate:
+			log.Printf("Key: \"%s\" Data: \"%s\" (update)\n", key, change.Value)
+		case changeDelete:
+			log.Printf("Key: \"%s\" (prune)\n", key)
+		case changeNoop:
+			if dryRun {
+				log.Printf("Key: \"%s\" Data: \"%s\" (no-op)\n", key, change.Value)
 			}
-			io.Copy(buf, file)
-			file.Close()
 		}
+	}
+}
+
+// changesToOps converts a plan into the etcd.Op batch that realizes it.
+func changesToOps(changes []kvChange) []etcd.Op {
+	ops := make([]etcd.Op, 0, len(changes))
+	for _, change := range changes {
+		switch change.Kind {
+		case changeAdd, changeUpdate:
+			ops = append(ops, etcd.OpPut(change.Key, string(change.Value)))
+		case changeDelete:
+			ops = append(ops, etcd.OpDelete(change.Key))
+		}
+	}
+	return ops
+}
+
+// chunkOps splits ops into chunks of at most size operations each, so that
+// no single etcd transaction exceeds the server's --max-txn-ops. size must
+// be greater than zero.
+func chunkOps(ops []etcd.Op, size int) [][]etcd.Op {
+	var chunks [][]etcd.Op
+	for len(ops) > 0 {
+		n := size
+		if n > len(ops) {
+			n = len(ops)
+		}
+		chunks = append(chunks, ops[:n])
+		ops = ops[n:]
+	}
+	return chunks
+}
 
-		writeEtcdKV(path, buf.Bytes())
-		log.Printf("Key: \"%s\" Data: \"File(%d Bytes)\"\n", strings.TrimLeft(path, "/"), buf.Len())
+// applyPlan commits every add/update/delete in changes, chunking into
+// multiple etcd transactions so no single Txn exceeds maxTxnOps operations.
+// Each chunk is committed atomically, but a failure partway through still
+// leaves earlier chunks applied -- true all-or-nothing import would require
+// a single Txn, which etcd's --max-txn-ops limit rules out for large trees.
+func applyPlan(ctx context.Context, changes []kvChange, maxTxnOps int) error {
+	for _, chunk := range chunkOps(changesToOps(changes), maxTxnOps) {
+		txnCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		resp, err := client.Txn(txnCtx).Then(chunk...).Commit()
+		cancel()
+		if err != nil {
+			return err
+		}
+		if resp.Header.Revision > lastAppliedRevision {
+			lastAppliedRevision = resp.Header.Revision
+		}
 	}
+
+	return nil
+}
+
+// doImport reads the YAML file, stages it against the current etcd state,
+// and applies the resulting plan. It is the default command's whole job,
+// and also what the watch subcommand re-runs on every file change, SIGHUP,
+// or --on-drift=revert.
+func doImport(c *cli.Context) error {
+	filePath := c.GlobalString("file")
+	if len(filePath) == 0 {
+		return fmt.Errorf("missing required parameter --file (--file app.yaml)")
+	}
+
+	maxTxnOps := c.GlobalInt("max-txn-ops")
+	if maxTxnOps <= 0 {
+		return fmt.Errorf("invalid --max-txn-ops %d, must be greater than zero", maxTxnOps)
+	}
+
+	root, err := loadConfig(filePath, c.GlobalString("format"))
+	if err != nil {
+		return err
+	}
+
+	prefix := strings.TrimRight(c.GlobalString("prefix"), "/")
+
+	kvs := make(map[string][]byte)
+	if err := collectKVs(prefix, root, kvs, newTemplater(c)); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	existing, err := fetchExisting(ctx, prefix)
+	if err != nil {
+		return err
+	}
+
+	dryRun := c.GlobalBool("dry-run")
+	changes := planChanges(kvs, existing, c.GlobalBool("prune"))
+	logPlan(changes, dryRun)
+
+	if dryRun {
+		return nil
+	}
+
+	return applyPlan(ctx, changes, maxTxnOps)
 }
 
 func main() {
@@ -98,7 +317,38 @@ func main() {
 		/services/nginx_hosts/web1/ssl_certficate => ... (cat ./ssl/web1.example.tld.crt ./ssl/sub_chain.crt ./ssl/ca.crt)
 		/services/nginx_hosts/web1/ssl_key => ... (cat ./ssl/web1.example.tld.key)
 
-		The default address for connecting etcd is http://127.0.0.1:2379.`
+		The default address for connecting etcd is http://127.0.0.1:2379.
+
+		For clusters that require mTLS or authentication, pass --cert/--key/--cacert
+		and --user/--password (or the equivalent ETCDCTL_CERT/ETCDCTL_KEY/ETCDCTL_CACERT/
+		ETCDCTL_USER/ETCDCTL_PASSWORD environment variables, same naming as etcdctl).
+
+		The whole YAML file is staged into a single batch and committed with one or
+		more etcd transactions (chunked at --max-txn-ops, default 128), so a failing
+		write can no longer leave etcd half-updated within a chunk. Pass --dry-run to
+		print the add/update/no-op diff against the current etcd state without writing
+		anything, and --prune to delete keys under the prefix that the YAML no longer
+		defines.
+
+		Run "etcd-kv-bootstrap watch" instead of the default import to keep the YAML
+		file and etcd in sync continuously rather than importing once.
+
+		--file is not limited to YAML: --format (or the file's extension) also
+		accepts json, hcl, and toml, as well as "dir" to load a directory tree where
+		<dir>/sub/key.txt becomes /sub/key (under --prefix) with the file's contents
+		as the value; the loaded directory's own name is not part of the key.
+
+		Scalar values may reference secrets instead of embedding them, so the config
+		file itself can be checked into git:
+			{{ env "VAR" }}                     -> value of the VAR environment variable
+			{{ file "/path/to/secret" }}         -> contents of a local file
+			{{ vault "secret/data/foo#field" }}  -> a field read from Vault (--vault-addr/
+			                                        --vault-token, or --vault-role-id/
+			                                        --vault-secret-id for AppRole)
+
+		Run "etcd-kv-bootstrap export" to do the reverse: dump everything under
+		--prefix back out as YAML/JSON/TOML, for backup or cluster-to-cluster
+		round-tripping.`
 	app.Version = "v0.1"
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
@@ -109,35 +359,86 @@ func main() {
 			Name:  "prefix, p",
 			Usage: "A etcd prefix for your YAML config (/test/bootstrap/)",
 		},
+		cli.StringFlag{
+			Name:  "format",
+			Usage: "Config source format: yaml, json, hcl, toml, or dir (directory tree); inferred from --file's extension (or dir-ness) if omitted",
+		},
 		cli.StringFlag{
 			Name:  "connect, c",
 			Usage: "A etcd endpoints (192.168.1.1:2379,192.168.1.2:2379)",
 		},
+		cli.StringFlag{
+			Name:   "cert",
+			Usage:  "Client TLS certificate for etcd (PEM)",
+			EnvVar: "ETCDCTL_CERT",
+		},
+		cli.StringFlag{
+			Name:   "key",
+			Usage:  "Client TLS key for etcd (PEM)",
+			EnvVar: "ETCDCTL_KEY",
+		},
+		cli.StringFlag{
+			Name:   "cacert",
+			Usage:  "CA bundle used to verify the etcd server certificate (PEM)",
+			EnvVar: "ETCDCTL_CACERT",
+		},
+		cli.StringFlag{
+			Name:   "user",
+			Usage:  "Username for etcd authentication",
+			EnvVar: "ETCDCTL_USER",
+		},
+		cli.StringFlag{
+			Name:   "password",
+			Usage:  "Password for etcd authentication",
+			EnvVar: "ETCDCTL_PASSWORD",
+		},
+		cli.BoolFlag{
+			Name:   "insecure-skip-verify",
+			Usage:  "Skip etcd server certificate verification",
+			EnvVar: "ETCDCTL_INSECURE_SKIP_VERIFY",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Print the planned key/value diff without writing to etcd",
+		},
+		cli.BoolFlag{
+			Name:  "prune",
+			Usage: "Delete keys under the prefix that are absent from the YAML file",
+		},
+		cli.IntFlag{
+			Name:  "max-txn-ops",
+			Usage: "Maximum operations per etcd transaction, must match the server's --max-txn-ops",
+			Value: defaultMaxTxnOps,
+		},
+		cli.StringFlag{
+			Name:   "vault-addr",
+			Usage:  "Vault address used to resolve {{ vault \"path#field\" }} references",
+			EnvVar: "VAULT_ADDR",
+		},
+		cli.StringFlag{
+			Name:   "vault-token",
+			Usage:  "Vault token used to resolve {{ vault \"path#field\" }} references",
+			EnvVar: "VAULT_TOKEN",
+		},
+		cli.StringFlag{
+			Name:  "vault-role-id",
+			Usage: "Vault AppRole role_id; when set, logs in via AppRole instead of --vault-token",
+		},
+		cli.StringFlag{
+			Name:  "vault-secret-id",
+			Usage: "Vault AppRole secret_id, used together with --vault-role-id",
+		},
 	}
+	app.Commands = []cli.Command{watchCommand, exportCommand}
 
-	app.Action = func(c *cli.Context) error {
-
-		if len(c.String("file")) == 0 {
-			fmt.Printf("Missing required parameter -file (-file app.yaml).\n")
-			os.Exit(1)
-		}
-
-		file, err := yaml.ReadFile(c.String("file"))
-		if err != nil {
-			fmt.Printf("Could not open file %s.\n", c.String("file"))
-			os.Exit(1)
-		}
+	app.Before = func(c *cli.Context) error {
+		return connectClient(c)
+	}
 
-		client, err = etcd.New(etcd.Config{
-			Endpoints:   strings.Split(c.String("connect"), ","),
-			DialTimeout: 5 * time.Second,
-		})
-		if err != nil {
+	app.Action = func(c *cli.Context) error {
+		if err := doImport(c); err != nil {
 			log.Fatal(err)
 		}
-
-		nodeIterator(strings.TrimRight(c.String("prefix"), "/"), file.Root)
-
 		return nil
 	}
 
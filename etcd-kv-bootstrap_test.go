@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+
+	etcd "go.etcd.io/etcd/clientv3"
+)
+
+func TestPlanChanges(t *testing.T) {
+	desired := map[string][]byte{
+		"/svc/a": []byte("new"),
+		"/svc/b": []byte("same"),
+	}
+	existing := map[string][]byte{
+		"/svc/b": []byte("same"),
+		"/svc/c": []byte("stale"),
+	}
+
+	changes := planChanges(desired, existing, true)
+
+	byKey := make(map[string]kvChange, len(changes))
+	for _, change := range changes {
+		byKey[change.Key] = change
+	}
+
+	if len(changes) != 3 {
+		t.Fatalf("expected 3 changes, got %d: %+v", len(changes), changes)
+	}
+	if got := byKey["/svc/a"].Kind; got != changeAdd {
+		t.Errorf("/svc/a: expected changeAdd, got %v", got)
+	}
+	if got := byKey["/svc/b"].Kind; got != changeNoop {
+		t.Errorf("/svc/b: expected changeNoop, got %v", got)
+	}
+	if got := byKey["/svc/c"].Kind; got != changeDelete {
+		t.Errorf("/svc/c: expected changeDelete, got %v", got)
+	}
+}
+
+func TestPlanChangesWithoutPrune(t *testing.T) {
+	desired := map[string][]byte{"/svc/a": []byte("new")}
+	existing := map[string][]byte{"/svc/c": []byte("stale")}
+
+	changes := planChanges(desired, existing, false)
+
+	for _, change := range changes {
+		if change.Kind == changeDelete {
+			t.Fatalf("did not expect a delete without --prune, got %+v", change)
+		}
+	}
+}
+
+func TestChangesToOps(t *testing.T) {
+	changes := []kvChange{
+		{Key: "/svc/a", Value: []byte("1"), Kind: changeAdd},
+		{Key: "/svc/b", Value: []byte("2"), Kind: changeUpdate},
+		{Key: "/svc/c", Kind: changeDelete},
+		{Key: "/svc/d", Value: []byte("unchanged"), Kind: changeNoop},
+	}
+
+	ops := changesToOps(changes)
+	if len(ops) != 3 {
+		t.Fatalf("expected 3 ops (no-ops skipped), got %d", len(ops))
+	}
+	if !ops[0].IsPut() || string(ops[0].KeyBytes()) != "/svc/a" || string(ops[0].ValueBytes()) != "1" {
+		t.Errorf("expected a put of /svc/a=1, got %+v", ops[0])
+	}
+	if !ops[1].IsPut() || string(ops[1].KeyBytes()) != "/svc/b" || string(ops[1].ValueBytes()) != "2" {
+		t.Errorf("expected a put of /svc/b=2, got %+v", ops[1])
+	}
+	if !ops[2].IsDelete() || string(ops[2].KeyBytes()) != "/svc/c" {
+		t.Errorf("expected a delete of /svc/c, got %+v", ops[2])
+	}
+}
+
+func TestChunkOps(t *testing.T) {
+	ops := make([]etcd.Op, 5)
+	for i := range ops {
+		ops[i] = etcd.OpPut("k", "v")
+	}
+
+	chunks := chunkOps(ops, 2)
+	if len(chunks) != 3 {
+		t.Fatalf("expected 3 chunks of size <= 2, got %d", len(chunks))
+	}
+	for i, want := range []int{2, 2, 1} {
+		if len(chunks[i]) != want {
+			t.Errorf("chunk %d: expected %d ops, got %d", i, want, len(chunks[i]))
+		}
+	}
+}
+
+func TestChunkOpsExactMultiple(t *testing.T) {
+	ops := make([]etcd.Op, 4)
+	for i := range ops {
+		ops[i] = etcd.OpPut("k", "v")
+	}
+
+	chunks := chunkOps(ops, 2)
+	if len(chunks) != 2 {
+		t.Fatalf("expected 2 chunks, got %d", len(chunks))
+	}
+}
+
+func TestChunkOpsEmpty(t *testing.T) {
+	if chunks := chunkOps(nil, 2); len(chunks) != 0 {
+		t.Fatalf("expected no chunks for an empty op list, got %d", len(chunks))
+	}
+}
+
+func TestChildPrefix(t *testing.T) {
+	if got := childPrefix("/service/demo"); got != "/service/demo/" {
+		t.Errorf("childPrefix(%q) = %q, want %q", "/service/demo", got, "/service/demo/")
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/BurntSushi/toml"
+	etcd "go.etcd.io/etcd/clientv3"
+	"gopkg.in/urfave/cli.v1"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var exportCommand = cli.Command{
+	Name:  "export",
+	Usage: "Dump an etcd prefix back out to YAML/JSON/TOML",
+	Description: `The inverse of the default import: reads every key under --prefix and
+reconstructs the nested map the import side would have produced from a config
+file, then writes it in --format (yaml, json, or toml; inferred from --output's
+extension, defaulting to yaml).`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "output, o",
+			Usage: "Where to write the export, or - for stdout",
+			Value: "-",
+		},
+		cli.StringFlag{
+			Name:  "binary-as",
+			Usage: "How to represent values that look binary: base64 (inline) or file (write to --files-dir)",
+			Value: "base64",
+		},
+		cli.StringFlag{
+			Name:  "files-dir",
+			Usage: "Directory materialized files are written under when --binary-as=file",
+			Value: "./exported-files",
+		},
+	},
+	Action: runExport,
+}
+
+func runExport(c *cli.Context) error {
+	binaryAs := c.String("binary-as")
+	if binaryAs != "base64" && binaryAs != "file" {
+		return fmt.Errorf("invalid --binary-as %q, must be base64 or file", binaryAs)
+	}
+
+	prefix := strings.TrimRight(c.GlobalString("prefix"), "/")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	resp, err := client.Get(ctx, childPrefix(prefix), etcd.WithPrefix())
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	tree := map[string]interface{}{}
+	for _, kv := range resp.Kvs {
+		parts := strings.Split(strings.TrimPrefix(string(kv.Key), prefix+"/"), "/")
+
+		value, err := exportValue(parts, kv.Value, binaryAs, c.String("files-dir"))
+		if err != nil {
+			return err
+		}
+		insertExportValue(tree, parts, value)
+	}
+
+	output := c.String("output")
+	format := c.GlobalString("format")
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(output)), ".")
+	}
+	if format == "" {
+		format = "yaml"
+	}
+
+	data, err := marshalTree(tree, format)
+	if err != nil {
+		return err
+	}
+
+	if output == "" || output == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	return ioutil.WriteFile(output, data, 0644)
+}
+
+// exportValue decides how a single etcd value should be represented in the
+// exported tree. Binary-looking values are either base64-encoded inline or
+// materialized to a file under filesDir and referenced as a one-element
+// list, mirroring the file-include list syntax the importer already reads.
+func exportValue(keyParts []string, value []byte, binaryAs, filesDir string) (interface{}, error) {
+	if !looksBinary(value) {
+		return string(value), nil
+	}
+
+	if binaryAs == "file" {
+		path, err := safeExportPath(filesDir, keyParts)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(path, value, 0644); err != nil {
+			return nil, err
+		}
+		return []string{path}, nil
+	}
+
+	return base64.StdEncoding.EncodeToString(value), nil
+}
+
+// safeExportPath joins filesDir with keyParts, refusing to do so if the
+// result would land outside filesDir. etcd keys are arbitrary byte strings
+// with no path-segment validation, so a key containing a literal ".."
+// segment -- written by a misbehaving client, or picked up externally by
+// "watch --on-drift" -- must not be allowed to escape filesDir via
+// filepath.Join.
+func safeExportPath(filesDir string, keyParts []string) (string, error) {
+	for _, part := range keyParts {
+		if part == "" || part == "." || part == ".." {
+			return "", fmt.Errorf("refusing to write file for etcd key with path segment %q", part)
+		}
+	}
+
+	path := filepath.Join(append([]string{filesDir}, keyParts...)...)
+
+	base, err := filepath.Abs(filesDir)
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if abs != base && !strings.HasPrefix(abs, base+string(filepath.Separator)) {
+		return "", fmt.Errorf("refusing to write file outside %s for etcd key %q", filesDir, strings.Join(keyParts, "/"))
+	}
+
+	return path, nil
+}
+
+func looksBinary(data []byte) bool {
+	if !utf8.Valid(data) {
+		return true
+	}
+	for _, b := range data {
+		if b == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func insertExportValue(tree map[string]interface{}, keyParts []string, value interface{}) {
+	cur := tree
+	for _, part := range keyParts[:len(keyParts)-1] {
+		next, ok := cur[part].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			cur[part] = next
+		}
+		cur = next
+	}
+	cur[keyParts[len(keyParts)-1]] = value
+}
+
+func marshalTree(tree map[string]interface{}, format string) ([]byte, error) {
+	switch format {
+	case "yaml", "yml":
+		return yaml.Marshal(tree)
+	case "json":
+		return json.MarshalIndent(tree, "", "  ")
+	case "toml":
+		var buf bytes.Buffer
+		if err := toml.NewEncoder(&buf).Encode(tree); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("unknown export format %q", format)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestLooksBinary(t *testing.T) {
+	if looksBinary([]byte("hello world")) {
+		t.Error("plain text should not look binary")
+	}
+	if !looksBinary([]byte{0xff, 0xfe, 0x00, 0x01}) {
+		t.Error("invalid UTF-8/NUL bytes should look binary")
+	}
+}
+
+func TestInsertExportValue(t *testing.T) {
+	tree := map[string]interface{}{}
+
+	insertExportValue(tree, []string{"services", "redis", "dsn"}, "tcp://127.0.0.1:6379")
+
+	services, ok := tree["services"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected services to be a map, got %+v", tree["services"])
+	}
+	redis, ok := services["redis"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected redis to be a map, got %+v", services["redis"])
+	}
+	if redis["dsn"] != "tcp://127.0.0.1:6379" {
+		t.Errorf("unexpected dsn: %v", redis["dsn"])
+	}
+}
+
+func TestSafeExportPathRejectsTraversal(t *testing.T) {
+	dir := t.TempDir()
+
+	if _, err := safeExportPath(dir, []string{"..", "..", "tmp", "evilfile"}); err == nil {
+		t.Fatal("expected an error for a key containing .. segments, got nil")
+	}
+	if _, err := safeExportPath(dir, []string{"certs", "..", "..", "evilfile"}); err == nil {
+		t.Fatal("expected an error for a key containing an embedded .. segment, got nil")
+	}
+	if _, err := safeExportPath(dir, []string{"certs", ""}); err == nil {
+		t.Fatal("expected an error for a key containing an empty segment, got nil")
+	}
+}
+
+func TestSafeExportPathAllowsOrdinaryKeys(t *testing.T) {
+	dir := t.TempDir()
+
+	path, err := safeExportPath(dir, []string{"certs", "web1", "leaf"})
+	if err != nil {
+		t.Fatalf("safeExportPath: %v", err)
+	}
+	want := filepath.Join(dir, "certs", "web1", "leaf")
+	if path != want {
+		t.Errorf("got %q, want %q", path, want)
+	}
+}
+
+func TestExportValuePlainText(t *testing.T) {
+	value, err := exportValue([]string{"svc", "name"}, []byte("web1"), "base64", "")
+	if err != nil {
+		t.Fatalf("exportValue: %v", err)
+	}
+	if value != "web1" {
+		t.Errorf("got %v, want %q", value, "web1")
+	}
+}
+
+func TestExportValueBinaryAsFileRejectsTraversal(t *testing.T) {
+	dir := t.TempDir()
+
+	_, err := exportValue([]string{"..", "..", "evilfile"}, []byte{0xff, 0xfe}, "file", dir)
+	if err == nil {
+		t.Fatal("expected exportValue to refuse a traversal-prone key, got nil")
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/hashicorp/hcl"
+	"github.com/kylelemons/go-gypsy/yaml"
+)
+
+// NodeKind distinguishes the three shapes a config source can produce once
+// loaded: a nested map, a plain value, or a list of files to concatenate.
+type NodeKind int
+
+const (
+	NodeMap NodeKind = iota
+	NodeScalar
+	NodeFileList
+)
+
+// Node is the intermediate tree every loader produces, decoupling
+// collectKVs from any one config format's own node type (originally
+// yaml.Node from go-gypsy).
+type Node struct {
+	Kind     NodeKind
+	Children map[string]*Node
+	Scalar   []byte
+	Files    []string
+}
+
+// loadConfig reads path with the loader selected by format, falling back to
+// the file's extension when format is empty. A path that is itself a
+// directory is loaded as a directory tree unless format says otherwise.
+func loadConfig(path, format string) (*Node, error) {
+	if format == "" {
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			format = "dir"
+		} else {
+			format = strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+		}
+	}
+
+	switch format {
+	case "yaml", "yml", "":
+		return loadYAML(path)
+	case "json":
+		return loadJSON(path)
+	case "hcl":
+		return loadHCL(path)
+	case "toml":
+		return loadTOML(path)
+	case "dir":
+		return loadDirTree(path)
+	default:
+		return nil, fmt.Errorf("unknown config format %q", format)
+	}
+}
+
+// loadYAML parses path with go-gypsy and converts its yaml.Node tree into
+// our format-agnostic Node tree.
+func loadYAML(path string) (*Node, error) {
+	file, err := yaml.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return nodeFromYAML(file.Root), nil
+}
+
+func nodeFromYAML(node yaml.Node) *Node {
+	if yamlMap, ok := node.(yaml.Map); ok {
+		children := make(map[string]*Node, len(yamlMap))
+		for key, child := range yamlMap {
+			children[key] = nodeFromYAML(child)
+		}
+		return &Node{Kind: NodeMap, Children: children}
+	}
+
+	if yamlScalar, ok := node.(yaml.Scalar); ok {
+		return &Node{Kind: NodeScalar, Scalar: []byte(yamlScalar)}
+	}
+
+	if yamlList, ok := node.(yaml.List); ok {
+		files := make([]string, 0, len(yamlList))
+		for _, item := range yamlList {
+			if scalar, ok := item.(yaml.Scalar); ok {
+				files = append(files, string(scalar))
+			}
+		}
+		return &Node{Kind: NodeFileList, Files: files}
+	}
+
+	return &Node{Kind: NodeMap, Children: map[string]*Node{}}
+}
+
+// loadJSON decodes path as JSON into the generic Node tree. JSON has no
+// notion of a "file include" list, so any array is treated the same way
+// YAML lists always have been: a list of file paths to concatenate.
+// Numbers are decoded via json.Number rather than the default float64, so
+// large integers (timestamps, numeric IDs) keep their exact digits instead
+// of being reformatted through floating point.
+func loadJSON(path string) (*Node, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return nil, fmt.Errorf("could not parse %s as JSON: %v", path, err)
+	}
+	return nodeFromValue(value), nil
+}
+
+// loadHCL decodes path as HCL into the generic Node tree.
+func loadHCL(path string) (*Node, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var value interface{}
+	if err := hcl.Unmarshal(data, &value); err != nil {
+		return nil, fmt.Errorf("could not parse %s as HCL: %v", path, err)
+	}
+	return nodeFromValue(value), nil
+}
+
+// loadTOML decodes path as TOML into the generic Node tree.
+func loadTOML(path string) (*Node, error) {
+	var value map[string]interface{}
+	if _, err := toml.DecodeFile(path, &value); err != nil {
+		return nil, fmt.Errorf("could not parse %s as TOML: %v", path, err)
+	}
+	return nodeFromValue(value), nil
+}
+
+// nodeFromValue builds a Node tree from the generic map[string]interface{}/
+// []interface{}/scalar shape that encoding/json, hcl, and toml all decode
+// into; hcl decodes nested blocks as []map[string]interface{}, whose maps
+// are merged into one NodeMap. json.Number (from loadJSON's UseNumber decoder) is rendered via its
+// own exact string form, and any other float64 (from HCL/TOML) is formatted
+// with strconv rather than fmt.Sprint, which renders large values in
+// scientific notation and would otherwise corrupt the stored value.
+func nodeFromValue(value interface{}) *Node {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		children := make(map[string]*Node, len(v))
+		for key, child := range v {
+			children[key] = nodeFromValue(child)
+		}
+		return &Node{Kind: NodeMap, Children: children}
+	case []interface{}:
+		files := make([]string, 0, len(v))
+		for _, item := range v {
+			files = append(files, fmt.Sprint(item))
+		}
+		return &Node{Kind: NodeFileList, Files: files}
+	case []map[string]interface{}:
+		merged := make(map[string]interface{})
+		for _, m := range v {
+			for key, child := range m {
+				merged[key] = child
+			}
+		}
+		return nodeFromValue(merged)
+	case json.Number:
+		return &Node{Kind: NodeScalar, Scalar: []byte(v.String())}
+	case float64:
+		return &Node{Kind: NodeScalar, Scalar: []byte(strconv.FormatFloat(v, 'f', -1, 64))}
+	default:
+		return &Node{Kind: NodeScalar, Scalar: []byte(fmt.Sprint(v))}
+	}
+}
+
+// loadDirTree turns a directory into a Node tree: each file's contents
+// become a scalar value at the path its directory structure implies,
+// relative to root and without the file extension, e.g. root/sub/key.txt
+// -> /sub/key.
+func loadDirTree(root string) (*Node, error) {
+	tree := &Node{Kind: NodeMap, Children: map[string]*Node{}}
+
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = strings.TrimSuffix(rel, filepath.Ext(rel))
+
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+
+		return insertScalar(tree, strings.Split(filepath.ToSlash(rel), "/"), data)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return tree, nil
+}
+
+// insertScalar places data at the path parts describes, creating
+// intermediate NodeMap levels as needed. It errors instead of silently
+// clobbering (or panicking on) a path that is both a file and a directory,
+// e.g. "ssl/web1.crt" next to "ssl/web1/ca.crt" -- an ordinary directory
+// shape that would otherwise lose data or corrupt the tree depending on
+// walk order.
+func insertScalar(root *Node, parts []string, data []byte) error {
+	cur := root
+	for i, part := range parts[:len(parts)-1] {
+		child, ok := cur.Children[part]
+		if !ok {
+			child = &Node{Kind: NodeMap, Children: map[string]*Node{}}
+			cur.Children[part] = child
+		} else if child.Kind != NodeMap {
+			return fmt.Errorf("%s is both a file and a directory", strings.Join(parts[:i+1], "/"))
+		}
+		cur = child
+	}
+
+	last := parts[len(parts)-1]
+	if _, exists := cur.Children[last]; exists {
+		return fmt.Errorf("%s is both a file and a directory", strings.Join(parts, "/"))
+	}
+
+	cur.Children[last] = &Node{Kind: NodeScalar, Scalar: data}
+	return nil
+}
+
+// collectKVs walks a Node tree and flattens its scalar/file-list leaves
+// into kvs, keyed by their fully qualified etcd path. Scalars are passed
+// through tmpl so that {{ env }}/{{ file }}/{{ vault }} references are
+// resolved before the value ever reaches etcd; file-list values are
+// concatenated raw and are not templated, since they are typically
+// certificates or other binary-ish includes.
+func collectKVs(path string, node *Node, kvs map[string][]byte, tmpl *templater) error {
+	switch node.Kind {
+	case NodeMap:
+		for key, child := range node.Children {
+			if err := collectKVs(fmt.Sprint(path, "/", key), child, kvs, tmpl); err != nil {
+				return err
+			}
+		}
+
+	case NodeScalar:
+		value, err := tmpl.expand(node.Scalar)
+		if err != nil {
+			return fmt.Errorf("expanding value for %q: %v", path, err)
+		}
+		kvs[path] = value
+
+	case NodeFileList:
+		buf := bytes.NewBuffer(nil)
+		for _, fileName := range node.Files {
+			file, err := os.Open(fileName)
+			if err != nil {
+				return err
+			}
+			io.Copy(buf, file)
+			file.Close()
+		}
+		kvs[path] = buf.Bytes()
+	}
+
+	return nil
+}
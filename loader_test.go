@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNodeFromValueScalars(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  string
+	}{
+		{"string", "hello", "hello"},
+		{"bool", true, "true"},
+		{"json.Number large integer", json.Number("1609459200123"), "1609459200123"},
+		{"json.Number decimal", json.Number("3.5"), "3.5"},
+		{"float64 large integer", float64(1609459200123), "1609459200123"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := nodeFromValue(tt.value)
+			if node.Kind != NodeScalar {
+				t.Fatalf("expected NodeScalar, got %v", node.Kind)
+			}
+			if got := string(node.Scalar); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNodeFromValueMapAndList(t *testing.T) {
+	value := map[string]interface{}{
+		"hostname": "web1.example.tld",
+		"certs":    []interface{}{"./ca.crt", "./leaf.crt"},
+	}
+
+	node := nodeFromValue(value)
+	if node.Kind != NodeMap {
+		t.Fatalf("expected NodeMap, got %v", node.Kind)
+	}
+
+	hostname, ok := node.Children["hostname"]
+	if !ok || hostname.Kind != NodeScalar || string(hostname.Scalar) != "web1.example.tld" {
+		t.Fatalf("unexpected hostname node: %+v", hostname)
+	}
+
+	certs, ok := node.Children["certs"]
+	if !ok || certs.Kind != NodeFileList {
+		t.Fatalf("unexpected certs node: %+v", certs)
+	}
+	if len(certs.Files) != 2 || certs.Files[0] != "./ca.crt" || certs.Files[1] != "./leaf.crt" {
+		t.Errorf("unexpected certs.Files: %v", certs.Files)
+	}
+}
+
+func TestInsertScalarBuildsNestedTree(t *testing.T) {
+	root := &Node{Kind: NodeMap, Children: map[string]*Node{}}
+
+	if err := insertScalar(root, []string{"services", "redis_dsn"}, []byte("tcp://127.0.0.1:6379")); err != nil {
+		t.Fatalf("insertScalar: %v", err)
+	}
+
+	services, ok := root.Children["services"]
+	if !ok || services.Kind != NodeMap {
+		t.Fatalf("expected services to be a NodeMap, got %+v", services)
+	}
+	dsn, ok := services.Children["redis_dsn"]
+	if !ok || dsn.Kind != NodeScalar || string(dsn.Scalar) != "tcp://127.0.0.1:6379" {
+		t.Fatalf("unexpected redis_dsn node: %+v", dsn)
+	}
+}
+
+func TestInsertScalarRejectsFileDirectoryCollision(t *testing.T) {
+	// "ssl/web1" as a file, then "ssl/web1/ca.crt" as a file under a
+	// same-named directory -- an ordinary layout that must error instead of
+	// silently losing data or panicking.
+	root := &Node{Kind: NodeMap, Children: map[string]*Node{}}
+
+	if err := insertScalar(root, []string{"ssl", "web1"}, []byte("leaf cert")); err != nil {
+		t.Fatalf("insertScalar: %v", err)
+	}
+
+	if err := insertScalar(root, []string{"ssl", "web1", "ca"}, []byte("ca cert")); err == nil {
+		t.Fatal("expected an error when a directory path collides with an existing file, got nil")
+	}
+}
+
+func TestInsertScalarRejectsFileDirectoryCollisionReverseOrder(t *testing.T) {
+	root := &Node{Kind: NodeMap, Children: map[string]*Node{}}
+
+	if err := insertScalar(root, []string{"ssl", "web1", "ca"}, []byte("ca cert")); err != nil {
+		t.Fatalf("insertScalar: %v", err)
+	}
+
+	if err := insertScalar(root, []string{"ssl", "web1"}, []byte("leaf cert")); err == nil {
+		t.Fatal("expected an error when a file collides with an existing directory, got nil")
+	}
+}
+
+func TestLoadDirTree(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "sub", "key.txt"), []byte("value"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	node, err := loadDirTree(dir)
+	if err != nil {
+		t.Fatalf("loadDirTree: %v", err)
+	}
+
+	sub, ok := node.Children["sub"]
+	if !ok || sub.Kind != NodeMap {
+		t.Fatalf("expected sub to be a NodeMap, got %+v", sub)
+	}
+	key, ok := sub.Children["key"]
+	if !ok || key.Kind != NodeScalar || string(key.Scalar) != "value" {
+		t.Fatalf("unexpected key node: %+v", key)
+	}
+}
+
+func TestLoadDirTreeRejectsFileDirectoryCollision(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "web1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "web1.txt"), []byte("leaf cert"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "web1", "ca.txt"), []byte("ca cert"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := loadDirTree(dir); err == nil {
+		t.Fatal("expected loadDirTree to error on a file/directory name collision, got nil")
+	}
+}
+
+func TestCollectKVs(t *testing.T) {
+	root := &Node{
+		Kind: NodeMap,
+		Children: map[string]*Node{
+			"redis_dsn": {Kind: NodeScalar, Scalar: []byte("tcp://127.0.0.1:6379")},
+		},
+	}
+
+	kvs := make(map[string][]byte)
+	if err := collectKVs("/services", root, kvs, &templater{}); err != nil {
+		t.Fatalf("collectKVs: %v", err)
+	}
+
+	if string(kvs["/services/redis_dsn"]) != "tcp://127.0.0.1:6379" {
+		t.Errorf("unexpected kvs: %v", kvs)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/template"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// templater expands {{ env "VAR" }}, {{ file "path" }}, and
+// {{ vault "secret/data/foo#field" }} references in scalar values before
+// they are written to etcd, so a YAML (or JSON/HCL/TOML) file can be
+// checked into git without embedding the secrets it configures.
+type templater struct {
+	vaultAddr     string
+	vaultToken    string
+	vaultRoleID   string
+	vaultSecretID string
+	vaultClient   *vaultapi.Client
+}
+
+// newTemplater reads the Vault connection flags/env vars. The Vault client
+// itself is created lazily, on the first {{ vault ... }} reference, so
+// files that don't use Vault never need VAULT_ADDR/VAULT_TOKEN set.
+func newTemplater(c *cli.Context) *templater {
+	return &templater{
+		vaultAddr:     c.GlobalString("vault-addr"),
+		vaultToken:    c.GlobalString("vault-token"),
+		vaultRoleID:   c.GlobalString("vault-role-id"),
+		vaultSecretID: c.GlobalString("vault-secret-id"),
+	}
+}
+
+// expand evaluates value as a text/template, making the env/file/vault
+// functions available to it.
+func (t *templater) expand(value []byte) ([]byte, error) {
+	tmpl, err := template.New("value").Funcs(template.FuncMap{
+		"env":   templateEnv,
+		"file":  templateFile,
+		"vault": t.templateVault,
+	}).Parse(string(value))
+	if err != nil {
+		return nil, fmt.Errorf("parsing template: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, nil); err != nil {
+		return nil, fmt.Errorf("executing template: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func templateEnv(name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %q is not set", name)
+	}
+	return value, nil
+}
+
+func templateFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// templateVault resolves a "path#field" reference against Vault, e.g.
+// "secret/data/foo#field" for a KV v2 mount.
+func (t *templater) templateVault(ref string) (string, error) {
+	idx := strings.LastIndex(ref, "#")
+	if idx < 0 {
+		return "", fmt.Errorf("vault reference %q must be of the form path#field", ref)
+	}
+	path, field := ref[:idx], ref[idx+1:]
+
+	client, err := t.vaultClientFor()
+	if err != nil {
+		return "", err
+	}
+
+	secret, err := client.Logical().Read(path)
+	if err != nil {
+		return "", fmt.Errorf("reading vault secret %q: %v", path, err)
+	}
+	if secret == nil {
+		return "", fmt.Errorf("vault secret %q not found", path)
+	}
+
+	data := secret.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+
+	value, ok := data[field]
+	if !ok {
+		return "", fmt.Errorf("vault secret %q has no field %q", path, field)
+	}
+	return fmt.Sprint(value), nil
+}
+
+// vaultClientFor lazily builds (and caches) the Vault client, logging in
+// via AppRole when --vault-role-id is set.
+func (t *templater) vaultClientFor() (*vaultapi.Client, error) {
+	if t.vaultClient != nil {
+		return t.vaultClient, nil
+	}
+
+	config := vaultapi.DefaultConfig()
+	if err := config.ReadEnvironment(); err != nil {
+		return nil, fmt.Errorf("reading Vault environment: %v", err)
+	}
+	if t.vaultAddr != "" {
+		config.Address = t.vaultAddr
+	}
+
+	client, err := vaultapi.NewClient(config)
+	if err != nil {
+		return nil, fmt.Errorf("creating Vault client: %v", err)
+	}
+
+	switch {
+	case t.vaultRoleID != "":
+		secret, err := client.Logical().Write("auth/approle/login", map[string]interface{}{
+			"role_id":   t.vaultRoleID,
+			"secret_id": t.vaultSecretID,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("vault AppRole login: %v", err)
+		}
+		if secret == nil || secret.Auth == nil {
+			return nil, fmt.Errorf("vault AppRole login returned no token")
+		}
+		client.SetToken(secret.Auth.ClientToken)
+	case t.vaultToken != "":
+		client.SetToken(t.vaultToken)
+	}
+
+	t.vaultClient = client
+	return t.vaultClient, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTemplaterExpandEnv(t *testing.T) {
+	os.Setenv("ETCD_KV_BOOTSTRAP_TEST_VAR", "shh")
+	defer os.Unsetenv("ETCD_KV_BOOTSTRAP_TEST_VAR")
+
+	tmpl := &templater{}
+	got, err := tmpl.expand([]byte(`{{ env "ETCD_KV_BOOTSTRAP_TEST_VAR" }}`))
+	if err != nil {
+		t.Fatalf("expand: %v", err)
+	}
+	if string(got) != "shh" {
+		t.Errorf("got %q, want %q", got, "shh")
+	}
+}
+
+func TestTemplaterExpandEnvMissing(t *testing.T) {
+	tmpl := &templater{}
+	if _, err := tmpl.expand([]byte(`{{ env "ETCD_KV_BOOTSTRAP_DOES_NOT_EXIST" }}`)); err == nil {
+		t.Fatal("expected an error for an unset environment variable, got nil")
+	}
+}
+
+func TestTemplaterExpandFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "secret.txt")
+	if err := os.WriteFile(path, []byte("top secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &templater{}
+	got, err := tmpl.expand([]byte(`{{ file "` + path + `" }}`))
+	if err != nil {
+		t.Fatalf("expand: %v", err)
+	}
+	if string(got) != "top secret" {
+		t.Errorf("got %q, want %q", got, "top secret")
+	}
+}
+
+func TestTemplaterExpandPassesThroughPlainValues(t *testing.T) {
+	tmpl := &templater{}
+	got, err := tmpl.expand([]byte("plain value, no templating"))
+	if err != nil {
+		t.Fatalf("expand: %v", err)
+	}
+	if string(got) != "plain value, no templating" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestTemplaterExpandVaultRequiresField(t *testing.T) {
+	tmpl := &templater{}
+	if _, err := tmpl.expand([]byte(`{{ vault "secret/data/foo" }}`)); err == nil {
+		t.Fatal("expected an error for a vault reference missing #field, got nil")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/fsnotify/fsnotify"
+	etcd "go.etcd.io/etcd/clientv3"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// Valid values for the watch subcommand's --on-drift flag.
+const (
+	onDriftLog    = "log"
+	onDriftRevert = "revert"
+	onDriftFail   = "fail"
+)
+
+var watchCommand = cli.Command{
+	Name:  "watch",
+	Usage: "Keep the YAML file and etcd in sync continuously instead of importing once",
+	Description: `Re-imports the YAML file whenever it changes on disk (watching its parent
+directory, so editor/config-management save patterns that rename a temp file
+over it are still picked up) or on SIGHUP, and watches the managed prefix in
+etcd so externally made changes ("drift") can be logged, reverted, or treated
+as fatal, selected via --on-drift.`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "on-drift",
+			Usage: "What to do when etcd drifts from the YAML file: log, revert, or fail",
+			Value: onDriftLog,
+		},
+	},
+	Action: runWatch,
+}
+
+// runWatch performs the initial import and then blocks, reconciling on file
+// changes, SIGHUP, and drift in etcd until the process is killed or
+// --on-drift=fail sees an external change.
+func runWatch(c *cli.Context) error {
+	onDrift := c.String("on-drift")
+	switch onDrift {
+	case onDriftLog, onDriftRevert, onDriftFail:
+	default:
+		return fmt.Errorf("invalid --on-drift %q, must be one of log, revert, fail", onDrift)
+	}
+
+	if err := doImport(c); err != nil {
+		return err
+	}
+
+	filePath := c.GlobalString("file")
+	prefix := strings.TrimRight(c.GlobalString("prefix"), "/")
+
+	// Watching filePath directly is not reliable: editors and config
+	// management tools commonly save by writing a temp file and renaming it
+	// over the original, which drops the kernel's inotify watch on that
+	// inode. Watch the parent directory instead and filter for filePath,
+	// the pattern fsnotify's own docs recommend.
+	dir := filepath.Dir(filePath)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	if err := watcher.Add(dir); err != nil {
+		return fmt.Errorf("could not watch %s: %v", dir, err)
+	}
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	watchChan := client.Watch(context.Background(), childPrefix(prefix), etcd.WithPrefix())
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if filepath.Clean(event.Name) != filepath.Clean(filePath) {
+				continue
+			}
+			if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+				if err := watcher.Add(dir); err != nil {
+					log.Printf("could not re-watch %s: %v\n", dir, err)
+				}
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+			log.Printf("%s changed, re-importing\n", filePath)
+			if err := doImport(c); err != nil {
+				log.Printf("re-import failed: %v\n", err)
+			}
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Printf("file watch error: %v\n", err)
+
+		case <-sighup:
+			log.Printf("received SIGHUP, re-importing\n")
+			if err := doImport(c); err != nil {
+				log.Printf("re-import failed: %v\n", err)
+			}
+
+		case resp, ok := <-watchChan:
+			if !ok {
+				return nil
+			}
+			if err := resp.Err(); err != nil {
+				log.Printf("etcd watch error: %v\n", err)
+				continue
+			}
+			for _, event := range resp.Events {
+				if event.Kv.ModRevision <= lastAppliedRevision {
+					continue
+				}
+				if err := handleDrift(c, onDrift, event); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// handleDrift reacts to an etcd event on the managed prefix that this
+// process did not itself cause.
+func handleDrift(c *cli.Context, onDrift string, event *etcd.Event) error {
+	key := string(event.Kv.Key)
+
+	switch onDrift {
+	case onDriftFail:
+		return fmt.Errorf("drift detected on %q, exiting as requested by --on-drift=fail", key)
+	case onDriftRevert:
+		log.Printf("drift detected on %q, reverting to the YAML file\n", key)
+		return doImport(c)
+	default:
+		log.Printf("drift detected on %q\n", key)
+		return nil
+	}
+}